@@ -0,0 +1,232 @@
+package revenue
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc/routerrpc"
+	"github.com/lightningnetwork/lnd/lnwire"
+)
+
+// observationWeight is the fixed weight given to a channel pair's prior
+// success probability when blending in the outcome of a new attempt,
+// modeled after the smoothing lnd's mission control applies on each
+// result. A higher weight means a single attempt moves the probability
+// less.
+const observationWeight = 0.8
+
+// failureEvent contains the information we require to penalize a channel
+// pair's success probability for a single failed routing attempt.
+type failureEvent struct {
+	incomingChannel string
+	outgoingChannel string
+	amt             lnwire.MilliSatoshi
+	timestamp       time.Time
+}
+
+// getFailures gets the set of failed routing attempts reported by
+// htlcEvents, and looks up the channel point for the incoming and outgoing
+// channel in each one using channelIDFound. Failures on channels we have no
+// record of are skipped, and htlc events that are not failures are
+// ignored.
+func getFailures(channelIDFound map[lnwire.ShortChannelID]string,
+	htlcEvents func() ([]*routerrpc.HtlcEvent, error)) ([]failureEvent,
+	error) {
+
+	rawEvents, err := htlcEvents()
+	if err != nil {
+		return nil, err
+	}
+
+	var failures []failureEvent
+	for _, event := range rawEvents {
+		amt, isFailure := failureAmt(event)
+		if !isFailure {
+			continue
+		}
+
+		chanInID := lnwire.NewShortChanIDFromInt(event.IncomingChannelId)
+		chanOutID := lnwire.NewShortChanIDFromInt(event.OutgoingChannelId)
+
+		inChannel, ok := channelIDFound[chanInID]
+		if !ok {
+			continue
+		}
+
+		outChannel, ok := channelIDFound[chanOutID]
+		if !ok {
+			continue
+		}
+
+		failures = append(failures, failureEvent{
+			incomingChannel: inChannel,
+			outgoingChannel: outChannel,
+			amt:             amt,
+			timestamp:       time.Unix(0, int64(event.TimestampNs)),
+		})
+	}
+
+	return failures, nil
+}
+
+// failureAmt returns the amount that a failed htlc event was forwarding,
+// and whether the event represents a link or forwarding failure at all.
+func failureAmt(event *routerrpc.HtlcEvent) (lnwire.MilliSatoshi, bool) {
+	switch e := event.Event.(type) {
+	case *routerrpc.HtlcEvent_LinkFailEvent:
+		if e.LinkFailEvent == nil || e.LinkFailEvent.Info == nil {
+			return 0, true
+		}
+
+		return lnwire.MilliSatoshi(
+			e.LinkFailEvent.Info.OutgoingAmtMsat,
+		), true
+
+	case *routerrpc.HtlcEvent_ForwardFailEvent:
+		return 0, true
+
+	default:
+		return 0, false
+	}
+}
+
+// pairStats accumulates the attempt, success and probability tracking for
+// a single directional channel pair as we fold its observations in, in
+// chronological order.
+type pairStats struct {
+	attempts     uint64
+	successes    uint64
+	prob         float64
+	haveObserved bool
+	lastTime     time.Time
+	lastFailTime time.Time
+	lastFailAmt  lnwire.MilliSatoshi
+}
+
+// observe folds a single observation - a success or a failure that
+// occurred at occurred - into a pair's running statistics.
+func (p *pairStats) observe(cfg *Config, occurred time.Time, success bool,
+	failAmt lnwire.MilliSatoshi) {
+
+	prob := cfg.AprioriProbability
+	if p.haveObserved {
+		prob = decayToApriori(
+			p.prob, cfg.AprioriProbability, cfg.DecayHalfLife,
+			occurred.Sub(p.lastTime),
+		)
+	}
+
+	outcome := 0.0
+	if success {
+		outcome = 1
+	}
+
+	prob = prob*observationWeight + outcome*(1-observationWeight)
+
+	p.attempts++
+	if success {
+		p.successes++
+	} else {
+		p.lastFailTime = occurred
+		p.lastFailAmt = failAmt
+
+		prob -= cfg.FailureAmtPenalty * float64(failAmt) / 1_000_000
+	}
+
+	switch {
+	case prob < 0:
+		prob = 0
+	case prob > 1:
+		prob = 1
+	}
+
+	p.prob = prob
+	p.lastTime = occurred
+	p.haveObserved = true
+}
+
+// decayToApriori blends prob back toward apriori, based on how much of
+// halfLife has elapsed since the pair's last observation. A pair that has
+// been idle for many half-lives ends up arbitrarily close to apriori; one
+// observed a moment ago is left almost untouched.
+func decayToApriori(prob, apriori float64, halfLife,
+	elapsed time.Duration) float64 {
+
+	if halfLife <= 0 || elapsed <= 0 {
+		return prob
+	}
+
+	decay := math.Exp(-math.Ln2 * elapsed.Seconds() / halfLife.Seconds())
+
+	return apriori + (prob-apriori)*decay
+}
+
+// addProbabilities folds every success and failure into the per-pair
+// statistics of report, in the order that they occurred, and writes the
+// resulting counters and success probability onto each pair's forward
+// direction.
+func addProbabilities(report *Report, cfg *Config, events []revenueEvent,
+	failures []failureEvent) {
+
+	type observation struct {
+		incomingChannel string
+		outgoingChannel string
+		occurred        time.Time
+		success         bool
+		amt             lnwire.MilliSatoshi
+	}
+
+	observations := make([]observation, 0, len(events)+len(failures))
+	for _, event := range events {
+		observations = append(observations, observation{
+			incomingChannel: event.incomingChannel,
+			outgoingChannel: event.outgoingChannel,
+			occurred:        event.timestamp,
+			success:         true,
+		})
+	}
+
+	for _, failure := range failures {
+		observations = append(observations, observation{
+			incomingChannel: failure.incomingChannel,
+			outgoingChannel: failure.outgoingChannel,
+			occurred:        failure.timestamp,
+			success:         false,
+			amt:             failure.amt,
+		})
+	}
+
+	sort.SliceStable(observations, func(i, j int) bool {
+		return observations[i].occurred.Before(observations[j].occurred)
+	})
+
+	stats := make(map[string]map[string]*pairStats)
+	for _, obs := range observations {
+		pairs, ok := stats[obs.incomingChannel]
+		if !ok {
+			pairs = make(map[string]*pairStats)
+			stats[obs.incomingChannel] = pairs
+		}
+
+		stat, ok := pairs[obs.outgoingChannel]
+		if !ok {
+			stat = &pairStats{}
+			pairs[obs.outgoingChannel] = stat
+		}
+
+		stat.observe(cfg, obs.occurred, obs.success, obs.amt)
+	}
+
+	for in, pairs := range stats {
+		for out, stat := range pairs {
+			revenue := pairsFor(report, in)[out]
+			revenue.Attempts = stat.attempts
+			revenue.Successes = stat.successes
+			revenue.SuccessProb = stat.prob
+			revenue.LastFailTime = stat.lastFailTime
+			revenue.LastFailAmtMsat = stat.lastFailAmt
+			pairsFor(report, in)[out] = revenue
+		}
+	}
+}
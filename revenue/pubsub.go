@@ -0,0 +1,350 @@
+package revenue
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/C-Otto/faraday/revenue/query"
+	"github.com/lightningnetwork/lnd/lnwire"
+)
+
+// OverflowPolicy determines how a subscriber's buffered channel is treated
+// once it is full.
+type OverflowPolicy int
+
+const (
+	// OverflowDropOldest drops the oldest event still buffered for the
+	// subscriber to make room for the new one, so that a slow
+	// subscriber never blocks the publisher.
+	OverflowDropOldest OverflowPolicy = iota
+
+	// OverflowBlock blocks the publisher until the subscriber has room
+	// in its buffer, so that a slow subscriber never misses an event.
+	OverflowBlock
+)
+
+// defaultSubscriberBuffer is the default number of events we buffer per
+// subscriber before the overflow policy is applied.
+const defaultSubscriberBuffer = 100
+
+// Event is a single revenue event delivered to subscribers, along with the
+// tags it was published with.
+type Event struct {
+	// IncomingChannel is the channel that the forward arrived on.
+	IncomingChannel string
+
+	// OutgoingChannel is the channel that the forward was sent out on.
+	OutgoingChannel string
+
+	// IncomingAmt is the amount that arrived on the incoming channel.
+	IncomingAmt lnwire.MilliSatoshi
+
+	// OutgoingAmt is the amount that was sent out on the outgoing
+	// channel.
+	OutgoingAmt lnwire.MilliSatoshi
+
+	// Tags are the key/value pairs that queries are matched against.
+	Tags query.Tags
+}
+
+// ServerConfig groups the functionality that the pubsub Server requires to
+// poll for new forwards and to decide how to treat slow subscribers.
+type ServerConfig struct {
+	// RevenueConfig provides access to our open and closed channels, and
+	// our forwarding history.
+	RevenueConfig *Config
+
+	// PollInterval is the frequency at which we poll for new forwarding
+	// events.
+	PollInterval time.Duration
+
+	// SubscriberBuffer is the number of events we buffer per subscriber
+	// before applying OverflowPolicy. If unset, defaultSubscriberBuffer
+	// is used.
+	SubscriberBuffer int
+
+	// OverflowPolicy determines how we treat a subscriber whose buffer
+	// is full.
+	OverflowPolicy OverflowPolicy
+}
+
+// subscriber holds the state we track for a single subscribed client.
+type subscriber struct {
+	query query.Query
+	out   chan<- Event
+}
+
+// Server is a long running pubsub subsystem that polls our forwarding
+// history and publishes each new forward to the subscribers whose query
+// matches the tags derived from it.
+type Server struct {
+	cfg *ServerConfig
+
+	mu          sync.Mutex
+	subscribers map[string]*subscriber
+
+	offset uint32
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewServer creates a new revenue pubsub Server.
+func NewServer(cfg *ServerConfig) *Server {
+	if cfg.SubscriberBuffer == 0 {
+		cfg.SubscriberBuffer = defaultSubscriberBuffer
+	}
+
+	return &Server{
+		cfg:         cfg,
+		subscribers: make(map[string]*subscriber),
+		quit:        make(chan struct{}),
+	}
+}
+
+// Start begins polling for forwarding events in the background, publishing
+// each one to subscribers as it arrives. It returns once the polling
+// goroutine has been started.
+func (s *Server) Start() error {
+	s.wg.Add(1)
+	go s.pollForwards()
+
+	return nil
+}
+
+// Stop shuts down the server and closes every subscriber's channel. It
+// waits for the poll goroutine - the only caller of publish - to return
+// before closing subscriber channels, so that a delivery in progress
+// cannot send on a closed channel.
+func (s *Server) Stop() {
+	close(s.quit)
+	s.wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, sub := range s.subscribers {
+		close(sub.out)
+		delete(s.subscribers, id)
+	}
+}
+
+// Subscribe registers a client to receive events that match the provided
+// query, and returns the channel that they will be delivered on. The
+// channel is buffered to the server's configured SubscriberBuffer, and
+// overflow is handled according to its OverflowPolicy. If clientID is
+// already subscribed, its previous channel is closed and replaced.
+func (s *Server) Subscribe(clientID string, q query.Query) <-chan Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if old, ok := s.subscribers[clientID]; ok {
+		close(old.out)
+	}
+
+	out := make(chan Event, s.cfg.SubscriberBuffer)
+	s.subscribers[clientID] = &subscriber{
+		query: q,
+		out:   out,
+	}
+
+	return out
+}
+
+// Unsubscribe removes a client's subscription. It is a no-op if the client
+// is not currently subscribed.
+func (s *Server) Unsubscribe(clientID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.subscribers, clientID)
+}
+
+// publish delivers event to every subscriber whose query matches tags,
+// applying the server's overflow policy to subscribers that are not
+// keeping up. It is called internally as events arrive from
+// publishNewForwards, always from within the poll goroutine tracked by
+// s.wg. Matching subscribers are snapshotted under the server's lock and
+// then delivered to without it held, so that a subscriber blocked on
+// OverflowBlock cannot stall delivery to other subscribers, or block a
+// concurrent Subscribe/Unsubscribe call.
+func (s *Server) publish(ctx context.Context, event revenueEvent,
+	tags query.Tags) {
+
+	out := Event{
+		IncomingChannel: event.incomingChannel,
+		OutgoingChannel: event.outgoingChannel,
+		IncomingAmt:     event.incomingAmt,
+		OutgoingAmt:     event.outgoingAmt,
+		Tags:            tags,
+	}
+
+	s.mu.Lock()
+	matched := make([]*subscriber, 0, len(s.subscribers))
+	for _, sub := range s.subscribers {
+		if sub.query.Matches(tags) {
+			matched = append(matched, sub)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, sub := range matched {
+		s.deliver(ctx, sub, out)
+	}
+}
+
+// deliver sends a single event to a subscriber, applying the server's
+// overflow policy if the subscriber's buffer is full.
+func (s *Server) deliver(ctx context.Context, sub *subscriber, event Event) {
+	if s.cfg.OverflowPolicy == OverflowBlock {
+		select {
+		case sub.out <- event:
+		case <-ctx.Done():
+		case <-s.quit:
+		}
+
+		return
+	}
+
+	select {
+	case sub.out <- event:
+		return
+	default:
+	}
+
+	// The subscriber's buffer is full, so we drop its oldest event to
+	// make room for this one. The subscriber may be reading from the
+	// channel concurrently, so neither the drop nor the send blocks.
+	select {
+	case <-sub.out:
+	default:
+	}
+
+	select {
+	case sub.out <- event:
+	default:
+	}
+}
+
+// pollForwards periodically queries for new forwarding events and
+// publishes them to subscribers, until the server is stopped.
+func (s *Server) pollForwards() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.publishNewForwards(context.Background())
+
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// publishNewForwards queries for forwarding events since the last offset we
+// observed, and publishes a tagged Event for each one we can resolve to a
+// known channel.
+func (s *Server) publishNewForwards(ctx context.Context) {
+	cfg := s.cfg.RevenueConfig
+
+	lookup, err := buildChannelLookup(cfg)
+	if err != nil {
+		return
+	}
+
+	peers, err := channelPeers(cfg)
+	if err != nil {
+		return
+	}
+
+	fwdEvents, offset, err := cfg.ForwardingHistory(
+		time.Time{}, time.Now(), s.offset, maxQueryEvents,
+	)
+	if err != nil {
+		return
+	}
+	s.offset = offset
+
+	for _, fwd := range fwdEvents {
+		chanInID := lnwire.NewShortChanIDFromInt(fwd.ChanIdIn)
+		chanOutID := lnwire.NewShortChanIDFromInt(fwd.ChanIdOut)
+
+		inChannel, ok := lookup[chanInID]
+		if !ok {
+			continue
+		}
+
+		outChannel, ok := lookup[chanOutID]
+		if !ok {
+			continue
+		}
+
+		event := revenueEvent{
+			incomingChannel: inChannel,
+			outgoingChannel: outChannel,
+			incomingAmt:     lnwire.MilliSatoshi(fwd.AmtInMsat),
+			outgoingAmt:     lnwire.MilliSatoshi(fwd.AmtOutMsat),
+			timestamp:       time.Unix(int64(fwd.Timestamp), 0),
+		}
+
+		fee := event.incomingAmt - event.outgoingAmt
+
+		tags := query.Tags{
+			"incoming_channel": inChannel,
+			"outgoing_channel": outChannel,
+			"incoming_peer":    peers[inChannel],
+			"outgoing_peer":    peers[outChannel],
+			"fee_msat_bucket":  feeBucket(fee),
+		}
+
+		s.publish(ctx, event, tags)
+	}
+}
+
+// channelPeers maps every channel point we know about, open or closed, to
+// the remote peer's pubkey.
+func channelPeers(cfg *Config) (map[string]string, error) {
+	openChannels, err := cfg.ListChannels()
+	if err != nil {
+		return nil, err
+	}
+
+	closedChannels, err := cfg.ClosedChannels()
+	if err != nil {
+		return nil, err
+	}
+
+	peers := make(map[string]string)
+	for _, channel := range openChannels {
+		peers[channel.ChannelPoint] = channel.RemotePubkey
+	}
+
+	for _, channel := range closedChannels {
+		peers[channel.ChannelPoint] = channel.RemotePubkey
+	}
+
+	return peers, nil
+}
+
+// feeBucket returns a human readable order-of-magnitude label for a fee
+// amount, so that queries like "fee_msat_bucket=1000-9999" are meaningful
+// without requiring an exact match.
+func feeBucket(feeMsat lnwire.MilliSatoshi) string {
+	switch {
+	case feeMsat < 100:
+		return "0-99"
+	case feeMsat < 1000:
+		return "100-999"
+	case feeMsat < 10000:
+		return "1000-9999"
+	case feeMsat < 100000:
+		return "10000-99999"
+	default:
+		return "100000+"
+	}
+}
@@ -0,0 +1,244 @@
+package revenue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/C-Otto/faraday/revenue/query"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/stretchr/testify/require"
+)
+
+// TestServerPublish tests that publishing forwarding events through a
+// Server only delivers them to subscribers whose query matches the tags
+// derived from the event.
+func TestServerPublish(t *testing.T) {
+	var (
+		chan1 = &lnrpc.Channel{
+			ChannelPoint: "a:1",
+			ChanId:       123,
+			RemotePubkey: "peer1",
+		}
+
+		chan2 = &lnrpc.Channel{
+			ChannelPoint: "a:2",
+			ChanId:       321,
+			RemotePubkey: "peer2",
+		}
+
+		fwdEvents = []*lnrpc.ForwardingEvent{
+			{
+				ChanIdIn:   chan1.ChanId,
+				ChanIdOut:  chan2.ChanId,
+				AmtInMsat:  1500,
+				AmtOutMsat: 1000,
+			},
+		}
+	)
+
+	cfg := &Config{
+		ListChannels: func() ([]*lnrpc.Channel, error) {
+			return []*lnrpc.Channel{chan1, chan2}, nil
+		},
+		ClosedChannels: func() ([]*lnrpc.ChannelCloseSummary, error) {
+			return nil, nil
+		},
+		ForwardingHistory: func(start, end time.Time, offset,
+			max uint32) ([]*lnrpc.ForwardingEvent, uint32, error) {
+
+			return fwdEvents, offset, nil
+		},
+	}
+
+	server := NewServer(&ServerConfig{
+		RevenueConfig: cfg,
+		PollInterval:  time.Hour,
+	})
+
+	// The "match" client subscribes with a query that matches the event
+	// we expect to publish.
+	matchQuery, err := query.Parse("incoming_channel=a:1 AND fee_msat_bucket=100-999")
+	require.NoError(t, err)
+
+	matchOut := server.Subscribe("match", matchQuery)
+
+	// The "mismatch" client subscribes with a query that cannot match
+	// any tag on our event.
+	mismatchQuery, err := query.Parse("incoming_channel=z:1")
+	require.NoError(t, err)
+
+	mismatchOut := server.Subscribe("mismatch", mismatchQuery)
+
+	// The "empty" client subscribes with a query that matches
+	// everything.
+	emptyOut := server.Subscribe("empty", query.Empty{})
+
+	server.publishNewForwards(context.Background())
+
+	expected := Event{
+		IncomingChannel: chan1.ChannelPoint,
+		OutgoingChannel: chan2.ChannelPoint,
+		IncomingAmt:     1500,
+		OutgoingAmt:     1000,
+		Tags: query.Tags{
+			"incoming_channel": chan1.ChannelPoint,
+			"outgoing_channel": chan2.ChannelPoint,
+			"incoming_peer":    chan1.RemotePubkey,
+			"outgoing_peer":    chan2.RemotePubkey,
+			"fee_msat_bucket":  "100-999",
+		},
+	}
+
+	select {
+	case got := <-matchOut:
+		require.Equal(t, expected, got)
+	default:
+		t.Fatal("expected matching subscriber to receive event")
+	}
+
+	select {
+	case got := <-emptyOut:
+		require.Equal(t, expected, got)
+	default:
+		t.Fatal("expected empty-query subscriber to receive event")
+	}
+
+	select {
+	case <-mismatchOut:
+		t.Fatal("mismatched subscriber should not have received event")
+	default:
+	}
+
+	server.Unsubscribe("empty")
+	server.publishNewForwards(context.Background())
+
+	select {
+	case <-emptyOut:
+		t.Fatal("unsubscribed client should not receive further events")
+	default:
+	}
+}
+
+// TestServerOverflowDropOldest tests that a subscriber using
+// OverflowDropOldest never blocks the publisher, and instead ends up with
+// the most recent events once its buffer is full, having dropped the
+// oldest ones to make room.
+func TestServerOverflowDropOldest(t *testing.T) {
+	server := NewServer(&ServerConfig{
+		PollInterval:     time.Hour,
+		SubscriberBuffer: 2,
+		OverflowPolicy:   OverflowDropOldest,
+	})
+
+	out := server.Subscribe("client", query.Empty{})
+
+	events := []revenueEvent{
+		{incomingChannel: "a:1"},
+		{incomingChannel: "a:2"},
+		{incomingChannel: "a:3"},
+	}
+
+	for _, event := range events {
+		server.publish(context.Background(), event, query.Tags{})
+	}
+
+	var got []string
+	for i := 0; i < 2; i++ {
+		select {
+		case event := <-out:
+			got = append(got, event.IncomingChannel)
+		default:
+			t.Fatalf("expected 2 buffered events, got %d", i)
+		}
+	}
+
+	require.Equal(t, []string{"a:2", "a:3"}, got)
+
+	select {
+	case <-out:
+		t.Fatal("expected buffer to contain only the two most recent events")
+	default:
+	}
+}
+
+// TestServerOverflowBlock tests that a subscriber using OverflowBlock
+// blocks the publisher once its buffer is full, and that the publisher is
+// unblocked as soon as the subscriber drains the buffer.
+func TestServerOverflowBlock(t *testing.T) {
+	server := NewServer(&ServerConfig{
+		PollInterval:     time.Hour,
+		SubscriberBuffer: 1,
+		OverflowPolicy:   OverflowBlock,
+	})
+
+	out := server.Subscribe("client", query.Empty{})
+
+	event1 := revenueEvent{incomingChannel: "a:1"}
+	event2 := revenueEvent{incomingChannel: "a:2"}
+
+	server.publish(context.Background(), event1, query.Tags{})
+
+	publishDone := make(chan struct{})
+	go func() {
+		server.publish(context.Background(), event2, query.Tags{})
+		close(publishDone)
+	}()
+
+	select {
+	case <-publishDone:
+		t.Fatal("expected publish to block while subscriber's buffer is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	select {
+	case event := <-out:
+		require.Equal(t, event1.incomingChannel, event.IncomingChannel)
+	default:
+		t.Fatal("expected first event to have been buffered")
+	}
+
+	select {
+	case <-publishDone:
+	case <-time.After(time.Second):
+		t.Fatal("expected blocked publish to complete once buffer drained")
+	}
+
+	select {
+	case event := <-out:
+		require.Equal(t, event2.incomingChannel, event.IncomingChannel)
+	default:
+		t.Fatal("expected second event to be delivered once unblocked")
+	}
+}
+
+// TestServerStop tests that stopping a server closes every remaining
+// subscriber's channel.
+func TestServerStop(t *testing.T) {
+	cfg := &Config{
+		ListChannels: func() ([]*lnrpc.Channel, error) {
+			return nil, nil
+		},
+		ClosedChannels: func() ([]*lnrpc.ChannelCloseSummary, error) {
+			return nil, nil
+		},
+		ForwardingHistory: func(start, end time.Time, offset,
+			max uint32) ([]*lnrpc.ForwardingEvent, uint32, error) {
+
+			return nil, offset, nil
+		},
+	}
+
+	server := NewServer(&ServerConfig{
+		RevenueConfig: cfg,
+		PollInterval:  time.Hour,
+	})
+
+	out := server.Subscribe("client", query.Empty{})
+
+	require.NoError(t, server.Start())
+	server.Stop()
+
+	_, ok := <-out
+	require.False(t, ok, "expected subscriber channel to be closed")
+}
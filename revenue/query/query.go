@@ -0,0 +1,163 @@
+// Package query provides predicates that can be used to select a subset of
+// tagged revenue events, for use by the revenue package's pubsub
+// subscribers.
+package query
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Tags is the set of key/value pairs attached to a published event.
+type Tags map[string]string
+
+// Query is implemented by anything that can decide whether a set of tags
+// is relevant to an interested subscriber.
+type Query interface {
+	// Matches returns true if the provided tags satisfy the query.
+	Matches(tags Tags) bool
+}
+
+// Empty is a Query that matches every set of tags. It is useful for
+// subscribers that want to receive every event published.
+type Empty struct{}
+
+// Matches always returns true, because Empty places no restriction on the
+// tags it is evaluated against.
+func (Empty) Matches(_ Tags) bool {
+	return true
+}
+
+// operator identifies the comparison performed by a single clause of a
+// parsed query.
+type operator int
+
+const (
+	// opEquals requires the tag's value to equal the query's value.
+	opEquals operator = iota
+
+	// opLessThan requires the tag's value to be numerically less than
+	// the query's value.
+	opLessThan
+
+	// opGreaterThan requires the tag's value to be numerically greater
+	// than the query's value.
+	opGreaterThan
+
+	// opContains requires the tag's value to contain the query's value
+	// as a substring.
+	opContains
+)
+
+// clause is a single "tag <op> value" comparison.
+type clause struct {
+	tag   string
+	op    operator
+	value string
+}
+
+// expression is a Query composed of one or more clauses, every one of
+// which must match for the expression as a whole to match.
+type expression struct {
+	clauses []clause
+}
+
+// Matches returns true if every clause in the expression is satisfied by
+// the provided tags.
+func (e *expression) Matches(tags Tags) bool {
+	for _, c := range e.clauses {
+		if !c.matches(tags) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matches evaluates a single clause against a set of tags.
+func (c clause) matches(tags Tags) bool {
+	value, ok := tags[c.tag]
+	if !ok {
+		return false
+	}
+
+	switch c.op {
+	case opEquals:
+		return value == c.value
+
+	case opContains:
+		return strings.Contains(value, c.value)
+
+	case opLessThan, opGreaterThan:
+		tagNum, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return false
+		}
+
+		queryNum, err := strconv.ParseFloat(c.value, 64)
+		if err != nil {
+			return false
+		}
+
+		if c.op == opLessThan {
+			return tagNum < queryNum
+		}
+
+		return tagNum > queryNum
+
+	default:
+		return false
+	}
+}
+
+// clauseSeparators lists the operator tokens we recognize, in the order we
+// attempt to match them. " CONTAINS " is checked before the single
+// character operators so that it is not mistaken for part of a value.
+var clauseSeparators = []struct {
+	sep string
+	op  operator
+}{
+	{sep: " CONTAINS ", op: opContains},
+	{sep: "=", op: opEquals},
+	{sep: "<", op: opLessThan},
+	{sep: ">", op: opGreaterThan},
+}
+
+// Parse builds a Query from a string expression of the form
+// "tag1=value1 AND tag2<value2 AND tag3 CONTAINS value3". Clauses are
+// combined with a logical AND; there is currently no support for OR or
+// grouping.
+func Parse(expr string) (Query, error) {
+	parts := strings.Split(expr, " AND ")
+
+	clauses := make([]clause, 0, len(parts))
+	for _, part := range parts {
+		c, err := parseClause(strings.TrimSpace(part))
+		if err != nil {
+			return nil, err
+		}
+
+		clauses = append(clauses, c)
+	}
+
+	return &expression{clauses: clauses}, nil
+}
+
+// parseClause parses a single "tag <op> value" clause out of an expression.
+func parseClause(part string) (clause, error) {
+	for _, candidate := range clauseSeparators {
+		idx := strings.Index(part, candidate.sep)
+		if idx < 0 {
+			continue
+		}
+
+		return clause{
+			tag:   strings.TrimSpace(part[:idx]),
+			op:    candidate.op,
+			value: strings.TrimSpace(part[idx+len(candidate.sep):]),
+		}, nil
+	}
+
+	return clause{}, fmt.Errorf("could not parse query clause: %q", part)
+}
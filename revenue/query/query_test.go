@@ -0,0 +1,137 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestEmptyMatches tests that Empty matches every set of tags, including
+// the empty set.
+func TestEmptyMatches(t *testing.T) {
+	var empty Empty
+
+	require.True(t, empty.Matches(Tags{"a": "1"}))
+	require.True(t, empty.Matches(Tags{}))
+}
+
+// TestParseErrors tests that Parse rejects expressions that do not contain
+// a clause it recognizes.
+func TestParseErrors(t *testing.T) {
+	tests := []string{
+		"no operator here",
+		"tag1=value1 AND no operator here",
+		"",
+	}
+
+	for _, expr := range tests {
+		expr := expr
+
+		t.Run(expr, func(t *testing.T) {
+			_, err := Parse(expr)
+			require.Error(t, err)
+		})
+	}
+}
+
+// TestParseMatches tests that a Query built by Parse matches tags as
+// expected for each of the operators it supports, including a multi-clause
+// AND expression.
+func TestParseMatches(t *testing.T) {
+	tests := []struct {
+		name   string
+		expr   string
+		tags   Tags
+		expect bool
+	}{
+		{
+			name:   "equals matches",
+			expr:   "tag1=value1",
+			tags:   Tags{"tag1": "value1"},
+			expect: true,
+		},
+		{
+			name:   "equals does not match",
+			expr:   "tag1=value1",
+			tags:   Tags{"tag1": "value2"},
+			expect: false,
+		},
+		{
+			name:   "equals tag missing",
+			expr:   "tag1=value1",
+			tags:   Tags{"tag2": "value1"},
+			expect: false,
+		},
+		{
+			name:   "contains matches",
+			expr:   "tag1 CONTAINS val",
+			tags:   Tags{"tag1": "value1"},
+			expect: true,
+		},
+		{
+			name:   "contains does not match",
+			expr:   "tag1 CONTAINS xyz",
+			tags:   Tags{"tag1": "value1"},
+			expect: false,
+		},
+		{
+			name:   "less than matches",
+			expr:   "tag1<100",
+			tags:   Tags{"tag1": "50"},
+			expect: true,
+		},
+		{
+			name:   "less than does not match",
+			expr:   "tag1<100",
+			tags:   Tags{"tag1": "150"},
+			expect: false,
+		},
+		{
+			name:   "greater than matches",
+			expr:   "tag1>100",
+			tags:   Tags{"tag1": "150"},
+			expect: true,
+		},
+		{
+			name:   "greater than does not match",
+			expr:   "tag1>100",
+			tags:   Tags{"tag1": "50"},
+			expect: false,
+		},
+		{
+			name:   "less than non-numeric tag value does not match",
+			expr:   "tag1<100",
+			tags:   Tags{"tag1": "not-a-number"},
+			expect: false,
+		},
+		{
+			name:   "greater than non-numeric tag value does not match",
+			expr:   "tag1>100",
+			tags:   Tags{"tag1": "not-a-number"},
+			expect: false,
+		},
+		{
+			name:   "multi-clause AND matches only when every clause does",
+			expr:   "tag1=value1 AND tag2>100",
+			tags:   Tags{"tag1": "value1", "tag2": "150"},
+			expect: true,
+		},
+		{
+			name:   "multi-clause AND fails on a single mismatched clause",
+			expr:   "tag1=value1 AND tag2>100",
+			tags:   Tags{"tag1": "value1", "tag2": "50"},
+			expect: false,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+			q, err := Parse(test.expr)
+			require.NoError(t, err)
+
+			require.Equal(t, test.expect, q.Matches(test.tags))
+		})
+	}
+}
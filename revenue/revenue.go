@@ -0,0 +1,395 @@
+// Package revenue contains the functionality required to produce a report
+// of the routing revenue earned by a node, broken down per channel pair.
+package revenue
+
+import (
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/routerrpc"
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/lightningnetwork/lnd/routing/route"
+)
+
+// maxQueryEvents is the maximum number of forwarding events we request from
+// lnd in a single call to ForwardingHistory.
+const maxQueryEvents = 500
+
+// Config provides revenue report creation with the functionality it needs
+// to obtain the set of channels we know about, and the forwards that
+// occurred over them.
+type Config struct {
+	// ListChannels returns a list of our currently open channels.
+	ListChannels func() ([]*lnrpc.Channel, error)
+
+	// ClosedChannels returns a list of our previously open, now closed
+	// channels.
+	ClosedChannels func() ([]*lnrpc.ChannelCloseSummary, error)
+
+	// ForwardingHistory returns a set of forwarding events that occurred
+	// between start and end, paginated by offset and capped at the
+	// maximum number of events provided. The time bound is pushed down
+	// to the source of the forwarding history, so that callers that
+	// only need a narrow range do not pay the cost of loading events
+	// outside of it.
+	ForwardingHistory forwardingHistory
+
+	// ChannelNode returns the remote node that the channel identified by
+	// chanPoint is connected to. It is required for peer-level
+	// aggregation of a revenue report.
+	ChannelNode func(chanPoint string) (route.Vertex, error)
+
+	// HTLCEvents returns the set of link and forwarding failures lnd has
+	// observed, used to penalize a channel pair's success probability.
+	// It may be left nil, in which case success probability is derived
+	// from successful forwards alone.
+	HTLCEvents func() ([]*routerrpc.HtlcEvent, error)
+
+	// AprioriProbability is the success probability assumed for a
+	// channel pair that we have not yet observed any attempts for, and
+	// the value that an idle pair's probability decays back toward.
+	AprioriProbability float64
+
+	// DecayHalfLife is the amount of time it takes for a channel pair's
+	// success probability to decay half way back to AprioriProbability
+	// once the pair stops being used.
+	DecayHalfLife time.Duration
+
+	// FailureAmtPenalty is the amount subtracted from a channel pair's
+	// SuccessProb for every 1,000,000 msat carried by a failed attempt,
+	// applied as each failure is observed, so that large failures
+	// suppress the pair's probability more than small ones.
+	FailureAmtPenalty float64
+}
+
+// forwardingHistory is the signature of a function that can be used to page
+// through a set of forwarding events that occurred between start and end.
+type forwardingHistory func(start, end time.Time, offset,
+	maxEvents uint32) ([]*lnrpc.ForwardingEvent, uint32, error)
+
+// revenueEvent contains the information we require to add a forward to our
+// revenue report.
+type revenueEvent struct {
+	incomingChannel string
+	outgoingChannel string
+	incomingAmt     lnwire.MilliSatoshi
+	outgoingAmt     lnwire.MilliSatoshi
+	timestamp       time.Time
+}
+
+// Revenue contains the volume and fee information that a channel earned as
+// the incoming or outgoing leg of forwards, from the perspective of a
+// single other channel that it forwarded to or from, along with our
+// routing success in that direction.
+type Revenue struct {
+	AmountOutgoing lnwire.MilliSatoshi
+	AmountIncoming lnwire.MilliSatoshi
+	FeesOutgoing   lnwire.MilliSatoshi
+	FeesIncoming   lnwire.MilliSatoshi
+
+	// Attempts is the number of times we have tried to route a payment
+	// with this channel as the incoming side and the other channel as
+	// the outgoing side.
+	Attempts uint64
+
+	// Successes is the number of those attempts that succeeded.
+	Successes uint64
+
+	// SuccessProb is our decayed estimate of the probability that the
+	// next attempt over this pair will succeed, modeled after lnd's
+	// mission control.
+	SuccessProb float64
+
+	// LastFailTime is the time of the most recent failed attempt over
+	// this pair.
+	LastFailTime time.Time
+
+	// LastFailAmtMsat is the amount that was being forwarded by the most
+	// recent failed attempt over this pair.
+	LastFailAmtMsat lnwire.MilliSatoshi
+}
+
+// Report contains a summary of the routing revenue that our node has
+// earned, expressed as a set of values per pair of channels.
+type Report struct {
+	// ChannelPairs maps a channel point to a map of the channel points it
+	// forwarded to or from, with the revenue earned from that pair.
+	ChannelPairs map[string]map[string]Revenue
+}
+
+// GetRevenueReport produces a revenue report for the lifetime of the node
+// that cfg is provided for.
+func GetRevenueReport(cfg *Config) (*Report, error) {
+	return GetRevenueReportForRange(cfg, time.Time{}, time.Now())
+}
+
+// GetRevenueReportForRange produces a revenue report for the forwards that
+// occurred between start and end.
+func GetRevenueReportForRange(cfg *Config, start, end time.Time) (*Report,
+	error) {
+
+	lookup, err := buildChannelLookup(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	events, err := getEvents(lookup, start, end, cfg.ForwardingHistory)
+	if err != nil {
+		return nil, err
+	}
+
+	var failures []failureEvent
+	if cfg.HTLCEvents != nil {
+		failures, err = getFailures(lookup, cfg.HTLCEvents)
+		if err != nil {
+			return nil, err
+		}
+
+		failures = inRange(failures, start, end)
+	}
+
+	return getReport(cfg, events, failures), nil
+}
+
+// inRange returns the subset of failures that occurred between start and
+// end.
+func inRange(failures []failureEvent, start, end time.Time) []failureEvent {
+	filtered := make([]failureEvent, 0, len(failures))
+	for _, failure := range failures {
+		if failure.timestamp.Before(start) || failure.timestamp.After(end) {
+			continue
+		}
+
+		filtered = append(filtered, failure)
+	}
+
+	return filtered
+}
+
+// PeerReport contains a summary of the routing revenue that our node has
+// earned, expressed as a set of values per pair of remote peers rather than
+// per pair of channels. Revenue earned across multiple channels opened with
+// the same peer over time - for example after a channel was closed and
+// later reopened - is summed together under that peer.
+type PeerReport struct {
+	// PeerPairs maps a peer's pubkey to a map of the peers it forwarded
+	// to or from, with the revenue earned from that pair.
+	PeerPairs map[route.Vertex]map[route.Vertex]Revenue
+}
+
+// GetPeerReportForRange produces a revenue report keyed by remote peer
+// rather than by channel point, for the forwards that occurred between
+// start and end.
+func GetPeerReportForRange(cfg *Config, start, end time.Time) (*PeerReport,
+	error) {
+
+	report, err := GetRevenueReportForRange(cfg, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	return toPeerReport(cfg, report)
+}
+
+// toPeerReport re-keys a channel-level report by the remote peer that each
+// channel belongs to, summing the revenue of any channels that share a
+// peer.
+func toPeerReport(cfg *Config, report *Report) (*PeerReport, error) {
+	peerReport := &PeerReport{
+		PeerPairs: make(map[route.Vertex]map[route.Vertex]Revenue),
+	}
+
+	for chanIn, pairs := range report.ChannelPairs {
+		peerIn, err := cfg.ChannelNode(chanIn)
+		if err != nil {
+			return nil, err
+		}
+
+		for chanOut, revenue := range pairs {
+			peerOut, err := cfg.ChannelNode(chanOut)
+			if err != nil {
+				return nil, err
+			}
+
+			addPeerRevenue(peerReport, peerIn, peerOut, revenue)
+		}
+	}
+
+	return peerReport, nil
+}
+
+// addPeerRevenue adds a single channel pair's revenue to the running total
+// for the equivalent pair of peers. Attempts and successes are summed
+// across every channel pair the peers have shared, SuccessProb is
+// recomputed as the attempts-weighted average of the pairs folded in so
+// far, and LastFailTime/LastFailAmtMsat are taken from whichever channel
+// pair failed most recently.
+func addPeerRevenue(report *PeerReport, in, out route.Vertex,
+	revenue Revenue) {
+
+	pairs, ok := report.PeerPairs[in]
+	if !ok {
+		pairs = make(map[route.Vertex]Revenue)
+		report.PeerPairs[in] = pairs
+	}
+
+	current := pairs[out]
+	current.AmountIncoming += revenue.AmountIncoming
+	current.AmountOutgoing += revenue.AmountOutgoing
+	current.FeesIncoming += revenue.FeesIncoming
+	current.FeesOutgoing += revenue.FeesOutgoing
+
+	totalAttempts := current.Attempts + revenue.Attempts
+	if totalAttempts > 0 {
+		current.SuccessProb = (current.SuccessProb*float64(current.Attempts) +
+			revenue.SuccessProb*float64(revenue.Attempts)) /
+			float64(totalAttempts)
+	}
+	current.Attempts = totalAttempts
+	current.Successes += revenue.Successes
+
+	if revenue.LastFailTime.After(current.LastFailTime) {
+		current.LastFailTime = revenue.LastFailTime
+		current.LastFailAmtMsat = revenue.LastFailAmtMsat
+	}
+
+	pairs[out] = current
+}
+
+// buildChannelLookup returns a map of short channel ID to channel point for
+// every channel we currently have open, or have ever had open and since
+// closed.
+func buildChannelLookup(cfg *Config) (map[lnwire.ShortChannelID]string,
+	error) {
+
+	openChannels, err := cfg.ListChannels()
+	if err != nil {
+		return nil, err
+	}
+
+	closedChannels, err := cfg.ClosedChannels()
+	if err != nil {
+		return nil, err
+	}
+
+	lookup := make(map[lnwire.ShortChannelID]string)
+	for _, channel := range openChannels {
+		chanID := lnwire.NewShortChanIDFromInt(channel.ChanId)
+		lookup[chanID] = channel.ChannelPoint
+	}
+
+	for _, channel := range closedChannels {
+		chanID := lnwire.NewShortChanIDFromInt(channel.ChanId)
+		lookup[chanID] = channel.ChannelPoint
+	}
+
+	return lookup, nil
+}
+
+// getEvents gets a set of forwarding events that occurred between start and
+// end from the query function provided, and looks up the channel point for
+// the incoming and outgoing channel in each event using channelIDFound. If
+// we cannot find the channel point for one of the channels in an event, we
+// skip it, since we have no record of a channel matching that ID.
+func getEvents(channelIDFound map[lnwire.ShortChannelID]string, start,
+	end time.Time, query forwardingHistory) ([]revenueEvent, error) {
+
+	var (
+		events []revenueEvent
+		offset uint32
+	)
+
+	for {
+		fwdEvents, lastOffset, err := query(
+			start, end, offset, maxQueryEvents,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, fwd := range fwdEvents {
+			chanInID := lnwire.NewShortChanIDFromInt(fwd.ChanIdIn)
+			chanOutID := lnwire.NewShortChanIDFromInt(fwd.ChanIdOut)
+
+			inChannel, ok := channelIDFound[chanInID]
+			if !ok {
+				continue
+			}
+
+			outChannel, ok := channelIDFound[chanOutID]
+			if !ok {
+				continue
+			}
+
+			events = append(events, revenueEvent{
+				incomingChannel: inChannel,
+				outgoingChannel: outChannel,
+				incomingAmt:     lnwire.MilliSatoshi(fwd.AmtInMsat),
+				outgoingAmt:     lnwire.MilliSatoshi(fwd.AmtOutMsat),
+				timestamp:       time.Unix(int64(fwd.Timestamp), 0),
+			})
+		}
+
+		offset = lastOffset
+
+		// The pagination package guarantees that we are out of
+		// events to query once we are returned less than the number
+		// of events we asked for.
+		if uint32(len(fwdEvents)) < maxQueryEvents {
+			break
+		}
+	}
+
+	return events, nil
+}
+
+// getReport produces a revenue report from a set of successful forwards and
+// failed attempts. Volume and fees are attributed to both sides of each
+// forward, but success tracking is directional: it only applies to the
+// (incoming, outgoing) pair that was actually attempted, since the reverse
+// pair was never tried.
+func getReport(cfg *Config, events []revenueEvent,
+	failures []failureEvent) *Report {
+
+	report := &Report{
+		ChannelPairs: make(map[string]map[string]Revenue),
+	}
+
+	for _, event := range events {
+		addEvent(report, event)
+	}
+
+	addProbabilities(report, cfg, events, failures)
+
+	return report
+}
+
+// addEvent adds the incoming and outgoing contribution of a single
+// revenue event to a report.
+func addEvent(report *Report, event revenueEvent) {
+	fee := event.incomingAmt - event.outgoingAmt
+
+	incoming := pairsFor(report, event.incomingChannel)
+	in := incoming[event.outgoingChannel]
+	in.AmountIncoming += event.incomingAmt
+	in.FeesIncoming += fee
+	incoming[event.outgoingChannel] = in
+
+	outgoing := pairsFor(report, event.outgoingChannel)
+	out := outgoing[event.incomingChannel]
+	out.AmountOutgoing += event.outgoingAmt
+	out.FeesOutgoing += fee
+	outgoing[event.incomingChannel] = out
+}
+
+// pairsFor returns the map of channel pair revenue for the given channel,
+// creating it if this is the first time we have seen the channel.
+func pairsFor(report *Report, channel string) map[string]Revenue {
+	pairs, ok := report.ChannelPairs[channel]
+	if !ok {
+		pairs = make(map[string]Revenue)
+		report.ChannelPairs[channel] = pairs
+	}
+
+	return pairs
+}
@@ -2,14 +2,26 @@ package revenue
 
 import (
 	"errors"
+	"fmt"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/lightningnetwork/lnd/lnrpc"
 	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/lightningnetwork/lnd/routing/route"
 	"github.com/stretchr/testify/require"
 )
 
+// vertexFromPubkey is a test helper that builds a route.Vertex out of a
+// human readable string, padding it out to the length of a real pubkey.
+func vertexFromPubkey(pubkey string) route.Vertex {
+	var vertex route.Vertex
+	copy(vertex[:], pubkey)
+
+	return vertex
+}
+
 // TestGetRevenueReport tests querying for a revenue report.
 func TestGetRevenueReport(t *testing.T) {
 	var (
@@ -26,10 +38,54 @@ func TestGetRevenueReport(t *testing.T) {
 			ChannelPoint: "a:2",
 			ChanId:       321,
 		}
+
+		peer1 = vertexFromPubkey("peer1")
+
+		// chan3 and chan4 are two closed channels that were both,
+		// over their lifetime, opened with peer1 - used to test that
+		// a peer report sums their revenue together.
+		chan3 = &lnrpc.ChannelCloseSummary{
+			ChannelPoint: "b:1",
+			ChanId:       555,
+			RemotePubkey: "peer1",
+		}
+
+		chan4 = &lnrpc.ChannelCloseSummary{
+			ChannelPoint: "b:2",
+			ChanId:       556,
+			RemotePubkey: "peer1",
+		}
+
+		// rangeStart and rangeEnd bound the window used by the time
+		// range test case below.
+		rangeStart = time.Unix(1000, 0)
+		rangeEnd   = time.Unix(2000, 0)
+
+		// testApriori and testHalfLife are used for every test case;
+		// a single successful first attempt over a pair always
+		// settles on testFirstAttemptProb, regardless of the channels
+		// involved.
+		testApriori          = 0.5
+		testHalfLife         = time.Hour
+		testFirstAttemptProb = testApriori*observationWeight + (1 - observationWeight)
 	)
 
+	// channelNode resolves a channel point to the peer it belongs to,
+	// using the set of channels declared above.
+	channelNode := func(chanPoint string) (route.Vertex, error) {
+		switch chanPoint {
+		case chan3.ChannelPoint, chan4.ChannelPoint:
+			return peer1, nil
+		default:
+			return route.Vertex{}, fmt.Errorf(
+				"no peer known for channel: %v", chanPoint)
+		}
+	}
+
 	tests := []struct {
 		name           string
+		start          time.Time
+		end            time.Time
 		listChanErr    error
 		closedChanErr  error
 		forwardHistErr error
@@ -37,7 +93,12 @@ func TestGetRevenueReport(t *testing.T) {
 		closedChannels []*lnrpc.ChannelCloseSummary
 		fwdHistory     []*lnrpc.ForwardingEvent
 		expectedReport *Report
-		expectErr      error
+
+		// expectedPeerReport, when set, is compared against the
+		// result of aggregating expectedReport by peer rather than
+		// by channel.
+		expectedPeerReport *PeerReport
+		expectErr          error
 	}{
 		{
 			name:        "open channels fails",
@@ -89,6 +150,9 @@ func TestGetRevenueReport(t *testing.T) {
 							AmountOutgoing: 0,
 							FeesIncoming:   50,
 							FeesOutgoing:   0,
+							Attempts:       1,
+							Successes:      1,
+							SuccessProb:    testFirstAttemptProb,
 						}},
 					chan2.ChannelPoint: {
 						chan1.ChannelPoint: Revenue{
@@ -100,6 +164,116 @@ func TestGetRevenueReport(t *testing.T) {
 				}},
 			expectErr: nil,
 		},
+		{
+			name:         "events outside range are excluded",
+			start:        rangeStart,
+			end:          rangeEnd,
+			openChannels: []*lnrpc.Channel{chan1, chan2},
+			fwdHistory: []*lnrpc.ForwardingEvent{
+				{
+					// before the range, excluded.
+					Timestamp:  uint64(rangeStart.Add(-time.Second).Unix()),
+					ChanIdIn:   chan1.ChanId,
+					ChanIdOut:  chan2.ChanId,
+					AmtOutMsat: 100,
+					AmtInMsat:  150,
+				},
+				{
+					// within the range, included.
+					Timestamp:  uint64(rangeStart.Add(time.Second).Unix()),
+					ChanIdIn:   chan1.ChanId,
+					ChanIdOut:  chan2.ChanId,
+					AmtOutMsat: 200,
+					AmtInMsat:  300,
+				},
+				{
+					// after the range, excluded.
+					Timestamp:  uint64(rangeEnd.Add(time.Second).Unix()),
+					ChanIdIn:   chan1.ChanId,
+					ChanIdOut:  chan2.ChanId,
+					AmtOutMsat: 400,
+					AmtInMsat:  600,
+				},
+			},
+			expectedReport: &Report{
+				ChannelPairs: map[string]map[string]Revenue{
+					chan1.ChannelPoint: {
+						chan2.ChannelPoint: Revenue{
+							AmountIncoming: 300,
+							FeesIncoming:   100,
+							Attempts:       1,
+							Successes:      1,
+							SuccessProb:    testFirstAttemptProb,
+						}},
+					chan2.ChannelPoint: {
+						chan1.ChannelPoint: Revenue{
+							AmountOutgoing: 200,
+							FeesOutgoing:   100,
+						}},
+				}},
+		},
+		{
+			name:           "same peer across two closed channels",
+			closedChannels: []*lnrpc.ChannelCloseSummary{chan3, chan4},
+			fwdHistory: []*lnrpc.ForwardingEvent{
+				{
+					ChanIdIn:   chan3.ChanId,
+					ChanIdOut:  chan4.ChanId,
+					AmtOutMsat: 100,
+					AmtInMsat:  150,
+				},
+				{
+					ChanIdIn:   chan4.ChanId,
+					ChanIdOut:  chan3.ChanId,
+					AmtOutMsat: 10,
+					AmtInMsat:  20,
+				},
+			},
+			expectedReport: &Report{
+				ChannelPairs: map[string]map[string]Revenue{
+					chan3.ChannelPoint: {
+						chan4.ChannelPoint: Revenue{
+							AmountIncoming: 150,
+							FeesIncoming:   50,
+							AmountOutgoing: 10,
+							FeesOutgoing:   10,
+							Attempts:       1,
+							Successes:      1,
+							SuccessProb:    testFirstAttemptProb,
+						}},
+					chan4.ChannelPoint: {
+						chan3.ChannelPoint: Revenue{
+							AmountOutgoing: 100,
+							FeesOutgoing:   50,
+							AmountIncoming: 20,
+							FeesIncoming:   10,
+							Attempts:       1,
+							Successes:      1,
+							SuccessProb:    testFirstAttemptProb,
+						}},
+				}},
+			// Both channels belong to peer1, so their revenue is
+			// summed into a single self-pair once aggregated by peer.
+			// The peer-level pair sums the two channel pairs'
+			// attempts and successes, and averages their success
+			// probabilities, since both channel pairs made exactly
+			// one attempt each at the same probability.
+			expectedPeerReport: &PeerReport{
+				PeerPairs: map[route.Vertex]map[route.Vertex]Revenue{
+					peer1: {
+						peer1: Revenue{
+							AmountIncoming: 170,
+							FeesIncoming:   60,
+							AmountOutgoing: 110,
+							FeesOutgoing:   60,
+							Attempts:       2,
+							Successes:      2,
+							SuccessProb:    testFirstAttemptProb,
+						},
+					},
+				},
+			},
+		},
 	}
 
 	for _, test := range tests {
@@ -115,14 +289,50 @@ func TestGetRevenueReport(t *testing.T) {
 				ClosedChannels: func() ([]*lnrpc.ChannelCloseSummary, error) {
 					return test.closedChannels, test.closedChanErr
 				},
-				ForwardingHistory: func(offset,
-					max uint32) ([]*lnrpc.ForwardingEvent, uint32, error) {
+				ForwardingHistory: func(start, end time.Time,
+					offset, max uint32) ([]*lnrpc.ForwardingEvent,
+					uint32, error) {
+
+					// Mimic lnd pushing the time bound down
+					// into the forwarding history query,
+					// rather than us filtering the full
+					// history after the fact.
+					filtered := make(
+						[]*lnrpc.ForwardingEvent, 0,
+						len(test.fwdHistory),
+					)
+					for _, event := range test.fwdHistory {
+						ts := time.Unix(
+							int64(event.Timestamp), 0,
+						)
+						if ts.Before(start) || ts.After(end) {
+							continue
+						}
+
+						filtered = append(filtered, event)
+					}
 
-					return test.fwdHistory, offset, test.forwardHistErr
+					return filtered, offset, test.forwardHistErr
 				},
+				ChannelNode: channelNode,
+
+				AprioriProbability: testApriori,
+				DecayHalfLife:      testHalfLife,
+			}
+
+			var (
+				report *Report
+				err    error
+			)
+
+			if !test.start.IsZero() || !test.end.IsZero() {
+				report, err = GetRevenueReportForRange(
+					cfg, test.start, test.end,
+				)
+			} else {
+				report, err = GetRevenueReport(cfg)
 			}
 
-			report, err := GetRevenueReport(cfg)
 			if test.expectErr != err {
 				t.Fatalf("expected: %v, got: %v",
 					test.expectErr, err)
@@ -133,10 +343,205 @@ func TestGetRevenueReport(t *testing.T) {
 					test.expectedReport, report)
 			}
 
+			if test.expectedPeerReport != nil {
+				peerReport, err := toPeerReport(cfg, report)
+				require.NoError(t, err)
+				require.Equal(
+					t, test.expectedPeerReport, peerReport,
+				)
+			}
+		})
+	}
+}
+
+// TestGetPeerReportForRange tests querying for a revenue report keyed by
+// peer end-to-end through GetPeerReportForRange, covering both the case
+// where every channel resolves to a peer and the case where ChannelNode
+// fails to resolve one, and the resulting error propagates out unchanged.
+func TestGetPeerReportForRange(t *testing.T) {
+	var (
+		// testErr is returned by channelNode for any channel point it
+		// does not recognize.
+		testErr = errors.New("no peer known for channel")
+
+		// chan1 and chan2 are open channels that channelNode below
+		// cannot resolve to a peer.
+		chan1 = &lnrpc.Channel{
+			ChannelPoint: "a:1",
+			ChanId:       123,
+		}
+
+		chan2 = &lnrpc.Channel{
+			ChannelPoint: "a:2",
+			ChanId:       321,
+		}
+
+		peer1 = vertexFromPubkey("peer1")
+
+		// chan3 and chan4 are closed channels that channelNode
+		// resolves to peer1.
+		chan3 = &lnrpc.ChannelCloseSummary{
+			ChannelPoint: "b:1",
+			ChanId:       555,
+		}
+
+		chan4 = &lnrpc.ChannelCloseSummary{
+			ChannelPoint: "b:2",
+			ChanId:       556,
+		}
+
+		testApriori          = 0.5
+		testFirstAttemptProb = testApriori*observationWeight + (1 - observationWeight)
+	)
+
+	// channelNode only knows how to resolve chan3 and chan4, to mimic a
+	// channel we no longer recognize.
+	channelNode := func(chanPoint string) (route.Vertex, error) {
+		switch chanPoint {
+		case chan3.ChannelPoint, chan4.ChannelPoint:
+			return peer1, nil
+		default:
+			return route.Vertex{}, testErr
+		}
+	}
+
+	tests := []struct {
+		name               string
+		openChannels       []*lnrpc.Channel
+		closedChannels     []*lnrpc.ChannelCloseSummary
+		fwdHistory         []*lnrpc.ForwardingEvent
+		expectedPeerReport *PeerReport
+		expectErr          error
+	}{
+		{
+			name:         "channel cannot be resolved to a peer",
+			openChannels: []*lnrpc.Channel{chan1, chan2},
+			fwdHistory: []*lnrpc.ForwardingEvent{
+				{
+					ChanIdIn:   chan1.ChanId,
+					ChanIdOut:  chan2.ChanId,
+					AmtOutMsat: 100,
+					AmtInMsat:  150,
+				},
+			},
+			expectErr: testErr,
+		},
+		{
+			name:           "channels resolve to a single peer",
+			closedChannels: []*lnrpc.ChannelCloseSummary{chan3, chan4},
+			fwdHistory: []*lnrpc.ForwardingEvent{
+				{
+					ChanIdIn:   chan3.ChanId,
+					ChanIdOut:  chan4.ChanId,
+					AmtOutMsat: 100,
+					AmtInMsat:  150,
+				},
+			},
+			expectedPeerReport: &PeerReport{
+				PeerPairs: map[route.Vertex]map[route.Vertex]Revenue{
+					peer1: {
+						peer1: Revenue{
+							AmountIncoming: 150,
+							FeesIncoming:   50,
+							Attempts:       1,
+							Successes:      1,
+							SuccessProb:    testFirstAttemptProb,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+			cfg := &Config{
+				ListChannels: func() ([]*lnrpc.Channel, error) {
+					return test.openChannels, nil
+				},
+				ClosedChannels: func() ([]*lnrpc.ChannelCloseSummary, error) {
+					return test.closedChannels, nil
+				},
+				ForwardingHistory: func(start, end time.Time,
+					offset, max uint32) ([]*lnrpc.ForwardingEvent,
+					uint32, error) {
+
+					return test.fwdHistory, offset, nil
+				},
+				ChannelNode: channelNode,
+
+				AprioriProbability: testApriori,
+			}
+
+			var noStart, noEnd time.Time
+
+			peerReport, err := GetPeerReportForRange(
+				cfg, noStart, noEnd,
+			)
+			require.Equal(t, test.expectErr, err)
+			require.Equal(t, test.expectedPeerReport, peerReport)
 		})
 	}
 }
 
+// TestAddPeerRevenue tests folding a channel pair's revenue into a peer
+// pair's running total, covering both the plain volume/fee summation and
+// the aggregation of attempt/success tracking across multiple channel
+// pairs belonging to the same two peers.
+func TestAddPeerRevenue(t *testing.T) {
+	var (
+		peerA = vertexFromPubkey("peerA")
+		peerB = vertexFromPubkey("peerB")
+
+		earlierFail = time.Unix(1000, 0)
+		laterFail   = time.Unix(2000, 0)
+	)
+
+	report := &PeerReport{
+		PeerPairs: make(map[route.Vertex]map[route.Vertex]Revenue),
+	}
+
+	addPeerRevenue(report, peerA, peerB, Revenue{
+		AmountIncoming:  100,
+		FeesIncoming:    10,
+		Attempts:        2,
+		Successes:       1,
+		SuccessProb:     0.4,
+		LastFailTime:    earlierFail,
+		LastFailAmtMsat: 500,
+	})
+
+	addPeerRevenue(report, peerA, peerB, Revenue{
+		AmountIncoming:  200,
+		FeesIncoming:    20,
+		Attempts:        3,
+		Successes:       3,
+		SuccessProb:     0.9,
+		LastFailTime:    laterFail,
+		LastFailAmtMsat: 700,
+	})
+
+	expected := &PeerReport{
+		PeerPairs: map[route.Vertex]map[route.Vertex]Revenue{
+			peerA: {
+				peerB: {
+					AmountIncoming:  300,
+					FeesIncoming:    30,
+					Attempts:        5,
+					Successes:       4,
+					SuccessProb:     0.7,
+					LastFailTime:    laterFail,
+					LastFailAmtMsat: 700,
+				},
+			},
+		},
+	}
+
+	require.Equal(t, expected, report)
+}
+
 // TestGetEvents tests fetching of forwarding events and lookup of our channel
 // point based on short channel ID. It tests cases where the lookup succeeds,
 // and where it fails and we are expected to skip the event. It does not test
@@ -156,8 +561,8 @@ func TestGetEvents(t *testing.T) {
 	}
 
 	// mockQuery returns our set of mocked events.
-	mockQuery := func(_, _ uint32) ([]*lnrpc.ForwardingEvent, uint32,
-		error) {
+	mockQuery := func(_, _ time.Time, _, _ uint32) (
+		[]*lnrpc.ForwardingEvent, uint32, error) {
 
 		return mockedEvents, 0, nil
 	}
@@ -170,7 +575,9 @@ func TestGetEvents(t *testing.T) {
 		chanOutID: chanOutOutpoint,
 	}
 
-	events, err := getEvents(channelIDFound, mockQuery)
+	var noStart, noEnd time.Time
+
+	events, err := getEvents(channelIDFound, noStart, noEnd, mockQuery)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -183,6 +590,7 @@ func TestGetEvents(t *testing.T) {
 			outgoingChannel: chanOutOutpoint,
 			incomingAmt:     events[0].incomingAmt,
 			outgoingAmt:     events[0].outgoingAmt,
+			timestamp:       time.Unix(0, 0),
 		},
 	}
 
@@ -192,7 +600,7 @@ func TestGetEvents(t *testing.T) {
 	// lookup the mapping from short channel ID to channel point). We expect
 	// getEvents to skip this event and succeed with an empty set of events.
 	channelNotFound := make(map[lnwire.ShortChannelID]string)
-	events, err = getEvents(channelNotFound, mockQuery)
+	events, err = getEvents(channelNotFound, noStart, noEnd, mockQuery)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -235,13 +643,54 @@ func TestGetReport(t *testing.T) {
 		outgoingAmt:     90,
 	}
 
+	// cfg is shared by every case below where only a single attempt is
+	// ever made over a pair, so that decay never comes into play: a
+	// single success over an apriori of 0.5 always settles on
+	// firstAttemptProb.
+	var (
+		apriori          = 0.5
+		firstAttemptProb = apriori*observationWeight + (1 - observationWeight)
+
+		cfg = &Config{AprioriProbability: apriori}
+	)
+
+	// interleavedProb is computed via the exact same sequence of
+	// operations as pairStats.observe, so that the expected value below
+	// is bit-for-bit exact despite not being a round decimal: a success,
+	// then a failure one half-life later, then another success one
+	// half-life after that.
+	interleavedProb := apriori*observationWeight + (1 - observationWeight)
+	interleavedProb = decayToApriori(
+		interleavedProb, apriori, time.Second, time.Second,
+	)
+	interleavedProb *= observationWeight
+	interleavedProb = decayToApriori(
+		interleavedProb, apriori, time.Second, time.Second,
+	)
+	interleavedProb = interleavedProb*observationWeight + (1 - observationWeight)
+
+	// t0 anchors the interleaved success/failure case below, so that the
+	// elapsed time between observations is exact multiples of halfLife.
+	t0 := time.Unix(1000, 0)
+
+	// decayCfg gives an idle pair a one second half-life back toward
+	// apriori, and disables the failure amount penalty so that only
+	// decay and the observation blend affect the probability.
+	decayCfg := &Config{
+		AprioriProbability: apriori,
+		DecayHalfLife:      time.Second,
+	}
+
 	tests := []struct {
 		name           string
+		cfg            *Config
 		events         []revenueEvent
+		failures       []failureEvent
 		expectedReport *Report
 	}{
 		{
 			name:   "no events",
+			cfg:    cfg,
 			events: []revenueEvent{},
 			expectedReport: &Report{
 				ChannelPairs: make(map[string]map[string]Revenue),
@@ -249,6 +698,7 @@ func TestGetReport(t *testing.T) {
 		},
 		{
 			name: "multiple forwards for one channel",
+			cfg:  cfg,
 			events: []revenueEvent{
 				chan1Incoming,
 				chan1Outgoing,
@@ -262,6 +712,9 @@ func TestGetReport(t *testing.T) {
 							AmountIncoming: 1000,
 							FeesOutgoing:   200,
 							FeesIncoming:   500,
+							Attempts:       1,
+							Successes:      1,
+							SuccessProb:    firstAttemptProb,
 						},
 					},
 					channel2: {
@@ -270,12 +723,72 @@ func TestGetReport(t *testing.T) {
 							AmountIncoming: 400,
 							FeesOutgoing:   500,
 							FeesIncoming:   200,
+							Attempts:       1,
+							Successes:      1,
+							SuccessProb:    firstAttemptProb,
 						},
 						channel2: {
 							AmountOutgoing: 90,
 							AmountIncoming: 100,
 							FeesOutgoing:   10,
 							FeesIncoming:   10,
+							Attempts:       1,
+							Successes:      1,
+							SuccessProb:    firstAttemptProb,
+						},
+					},
+				},
+			},
+		},
+		{
+			// This case interleaves a success, a failure and a
+			// success on the same pair, one half-life apart, and
+			// checks the final probability against the value
+			// produced by applying each outcome, with decay in
+			// between, in that order.
+			name: "interleaved successes and failures decay toward apriori",
+			cfg:  decayCfg,
+			events: []revenueEvent{
+				{
+					incomingChannel: channel1,
+					outgoingChannel: channel2,
+					incomingAmt:     1000,
+					outgoingAmt:     900,
+					timestamp:       t0,
+				},
+				{
+					incomingChannel: channel1,
+					outgoingChannel: channel2,
+					incomingAmt:     2000,
+					outgoingAmt:     1800,
+					timestamp:       t0.Add(2 * time.Second),
+				},
+			},
+			failures: []failureEvent{
+				{
+					incomingChannel: channel1,
+					outgoingChannel: channel2,
+					amt:             1234,
+					timestamp:       t0.Add(time.Second),
+				},
+			},
+			expectedReport: &Report{
+				ChannelPairs: map[string]map[string]Revenue{
+					channel1: {
+						channel2: {
+							AmountIncoming:  3000,
+							FeesIncoming:    300,
+							Attempts:        3,
+							Successes:       2,
+							SuccessProb:     interleavedProb,
+							LastFailTime:    t0.Add(time.Second),
+							LastFailAmtMsat: 1234,
+						},
+					},
+					channel2: {
+						channel1: {
+							AmountOutgoing: 2700,
+							FeesOutgoing:   300,
 						},
 					},
 				},
@@ -287,7 +800,7 @@ func TestGetReport(t *testing.T) {
 		test := test
 
 		t.Run(test.name, func(t *testing.T) {
-			report := getReport(test.events)
+			report := getReport(test.cfg, test.events, test.failures)
 
 			if !reflect.DeepEqual(report, test.expectedReport) {
 				t.Fatalf("expected revenue: %v, got: %v",